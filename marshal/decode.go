@@ -0,0 +1,713 @@
+package marshal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+// byteReader is the subset of *bufio.Reader the Decoder relies on, narrowed
+// so decodeUserMarshal can swap in a teeReader that records the raw bytes of
+// a nested value as it's consumed.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Decoder reads a Marshal 4.8 stream incrementally, resolving only as many
+// bytes as are needed for the next token rather than requiring the whole
+// payload up front. This lets callers decode values straight off a network
+// socket or a large Rails cache dump without buffering the entire blob, the
+// way CreateMarshalledObject and its []byte-backed MarshalledObject tree
+// require.
+type Decoder struct {
+	r       byteReader
+	symbols []string
+	objects []interface{}
+	started bool
+}
+
+// NewDecoder returns a new Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next Marshal-encoded value from the stream and stores it
+// in the value pointed to by v, following the same typed-unmarshal rules as
+// Unmarshal.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("gorails/marshal: Decode target must be a non-nil pointer")
+	}
+
+	if !d.started {
+		if _, err := d.r.ReadByte(); err != nil {
+			return err
+		}
+		if _, err := d.r.ReadByte(); err != nil {
+			return err
+		}
+		d.started = true
+	}
+
+	return d.decodeValue(rv.Elem())
+}
+
+func (d *Decoder) decodeValue(rv reflect.Value) error {
+	value, err := d.decodeDynamic()
+	if err != nil {
+		return err
+	}
+	return assignDynamic(rv, value)
+}
+
+// decodeDynamic reads the next value off the stream as a plain Go value
+// (nil, bool, int64, float64, *big.Int, string, Symbol, []interface{} or
+// map[string]interface{}), or as one of the userDefinedValue,
+// userMarshalValue, objectInstanceValue or structValue carriers for the
+// types that need further resolution, registering it in the object cache
+// exactly when cacheObject would for a MarshalledObject.
+func (d *Decoder) decodeDynamic() (interface{}, error) {
+	tag, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tag {
+	case '0':
+		return nil, nil
+	case 'T':
+		return true, nil
+	case 'F':
+		return false, nil
+	case 'i':
+		return d.readInt()
+	case 'f':
+		str, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, err
+		}
+		d.cacheObject(value)
+		return value, nil
+	case ':':
+		sym, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		d.symbols = append(d.symbols, sym)
+		return Symbol(sym), nil
+	case ';':
+		idx, err := d.readInt()
+		if err != nil {
+			return nil, err
+		}
+		if int(idx) >= len(d.symbols) {
+			return nil, IncompleteData
+		}
+		return Symbol(d.symbols[idx]), nil
+	case '"':
+		str, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		d.cacheObject(str)
+		return str, nil
+	case 'I':
+		return d.decodeIVar()
+	case '@':
+		idx, err := d.readInt()
+		if err != nil {
+			return nil, err
+		}
+		if int(idx) >= len(d.objects) {
+			return nil, IncompleteData
+		}
+		return d.objects[idx], nil
+	case '[':
+		return d.decodeArray()
+	case '{':
+		return d.decodeMap()
+	case 'u':
+		return d.decodeUserDefined()
+	case 'U', 'd':
+		return d.decodeUserMarshal()
+	case 'o':
+		return d.decodeObjectInstance()
+	case 'l':
+		return d.decodeBignum()
+	case 'c', 'm', 'M':
+		str, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		d.cacheObject(str)
+		return str, nil
+	case 'S':
+		return d.decodeStruct()
+	case '/':
+		return d.decodeRegexp()
+	case 'C', 'e':
+		// The class/module name symbol is discarded: decodeDynamic has no
+		// equivalent of GetClassName to attach it to, so a C/e-wrapped value
+		// (e.g. ActiveSupport::HashWithIndifferentAccess) just decodes
+		// transparently as its wrapped type. Ruby assigns one object link to
+		// the wrapped value as a whole, and decoding straight into it here
+		// lets the wrapped value's own case (array/map/string/...) register
+		// that single slot, rather than registering a second one for the
+		// wrapper.
+		if _, err := d.decodeDynamic(); err != nil {
+			return nil, err
+		}
+		return d.decodeDynamic()
+	default:
+		return nil, UnsupportedType{tag}
+	}
+}
+
+// decodeIVar reads an `I` (IVAR-wrapped) value: the wrapped value itself --
+// almost always a String, but the format allows any value -- followed by its
+// (name, value) instance-variable pairs (e.g. the `@E` encoding flag Ruby
+// attaches to a UTF-8 String). The pairs always follow the wrapped value
+// regardless of its type, so they're read and discarded here unconditionally
+// rather than only for a wrapped String; skipping that for any other wrapped
+// type would leave the reader desynced for everything that follows.
+func (d *Decoder) decodeIVar() (interface{}, error) {
+	value, err := d.decodeDynamic()
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < count; i++ {
+		if _, err := d.decodeDynamic(); err != nil {
+			return nil, err
+		}
+		if _, err := d.decodeDynamic(); err != nil {
+			return nil, err
+		}
+	}
+
+	return value, nil
+}
+
+func (d *Decoder) decodeArray() (interface{}, error) {
+	size, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	array := make([]interface{}, size)
+	d.cacheObject(array)
+
+	for i := int64(0); i < size; i++ {
+		value, err := d.decodeDynamic()
+		if err != nil {
+			return nil, err
+		}
+		array[i] = value
+	}
+
+	return array, nil
+}
+
+func (d *Decoder) decodeMap() (interface{}, error) {
+	size, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{}, size)
+	d.cacheObject(m)
+
+	for i := int64(0); i < size; i++ {
+		key, err := d.decodeDynamic()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decodeDynamic()
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprint(key)] = value
+	}
+
+	return m, nil
+}
+
+func (d *Decoder) decodeUserDefined() (interface{}, error) {
+	className, err := d.decodeDynamic()
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(d.r, payload); err != nil {
+		return nil, err
+	}
+
+	value := userDefinedValue{className: fmt.Sprint(className), payload: payload}
+	d.cacheObject(value)
+	return value, nil
+}
+
+// decodeUserMarshal reads a `U` (TYPE_USER_MARSHAL) value: a class name
+// followed by a single nested Marshal value (the result of the class's
+// marshal_dump). Registered userMarshalRegistry loaders want that nested
+// value as a *MarshalledObject, so decodeUserMarshal tees the raw bytes
+// consumed while decoding it and builds one from the capture, the same way
+// CreateMarshalledObject builds one from a whole payload.
+//
+// Ruby assigns this value its object link before writing the nested value,
+// so its cache slot is reserved before recursing into decodeDynamic for the
+// nested value and only filled in afterward -- otherwise a nested value that
+// also gets a link (an Array, say) would end up claiming the index Ruby
+// meant for this one.
+func (d *Decoder) decodeUserMarshal() (interface{}, error) {
+	className, err := d.decodeDynamic()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := d.reserveObject()
+
+	var raw bytes.Buffer
+	saved := d.r
+	d.r = &teeReader{r: saved, buf: &raw}
+	_, err = d.decodeDynamic()
+	d.r = saved
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := CreateMarshalledObject(append([]byte{4, 8}, raw.Bytes()...))
+	value := userMarshalValue{className: fmt.Sprint(className), wrapped: wrapped}
+	d.fillReservedObject(idx, value)
+	return value, nil
+}
+
+// teeReader wraps a byteReader, recording every byte actually consumed via
+// ReadByte/Read into buf.
+type teeReader struct {
+	r   byteReader
+	buf *bytes.Buffer
+}
+
+func (t *teeReader) ReadByte() (byte, error) {
+	b, err := t.r.ReadByte()
+	if err == nil {
+		t.buf.WriteByte(b)
+	}
+	return b, err
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// decodeObjectInstance reads an `o` (TYPE_OBJECT_INSTANCE) value. As with
+// decodeUserMarshal, Ruby assigns this object its link before writing its
+// ivars, so the cache slot is reserved up front in case an ivar value is
+// itself a back-reference to this same object.
+func (d *Decoder) decodeObjectInstance() (interface{}, error) {
+	className, err := d.decodeDynamic()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := d.reserveObject()
+
+	count, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	ivars := make(map[string]interface{}, count)
+	for i := int64(0); i < count; i++ {
+		name, err := d.decodeDynamic()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decodeDynamic()
+		if err != nil {
+			return nil, err
+		}
+		ivars[fmt.Sprint(name)] = value
+	}
+
+	instance := objectInstanceValue{className: fmt.Sprint(className), ivars: ivars}
+	d.fillReservedObject(idx, instance)
+	return instance, nil
+}
+
+// decodeBignum reads an `l` (TYPE_BIGNUM) value into an arbitrary-precision
+// integer, mirroring GetAsBignum's sign+word-count+little-endian-words
+// layout.
+func (d *Decoder) decodeBignum() (interface{}, error) {
+	sign, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	wordCount, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, wordCount*2)
+	if _, err := io.ReadFull(d.r, raw); err != nil {
+		return nil, err
+	}
+
+	bigEndian := make([]byte, len(raw))
+	for i, b := range raw {
+		bigEndian[len(raw)-1-i] = b
+	}
+
+	value := new(big.Int).SetBytes(bigEndian)
+	if sign == '-' {
+		value.Neg(value)
+	}
+
+	d.cacheObject(value)
+	return value, nil
+}
+
+// decodeStruct reads an `S` (TYPE_STRUCT) value: a class name followed by a
+// count and that many (member-name, value) pairs, mirroring GetAsStruct.
+// Ruby assigns this value its link before writing its members, so the cache
+// slot is reserved up front as decodeUserMarshal and decodeObjectInstance do.
+func (d *Decoder) decodeStruct() (interface{}, error) {
+	className, err := d.decodeDynamic()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := d.reserveObject()
+
+	count, err := d.readInt()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]interface{}, count)
+	for i := int64(0); i < count; i++ {
+		name, err := d.decodeDynamic()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decodeDynamic()
+		if err != nil {
+			return nil, err
+		}
+		fields[fmt.Sprint(name)] = value
+	}
+
+	instance := structValue{className: fmt.Sprint(className), fields: fields}
+	d.fillReservedObject(idx, instance)
+	return instance, nil
+}
+
+// decodeRegexp reads a `/` (TYPE_REGEXP) value into its source pattern,
+// discarding the trailing Ruby options byte -- the same simplification
+// Unmarshal makes for a TYPE_REGEXP value (see GetAsRegexp).
+func (d *Decoder) decodeRegexp() (interface{}, error) {
+	pattern, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.r.ReadByte(); err != nil {
+		return nil, err
+	}
+
+	d.cacheObject(pattern)
+	return pattern, nil
+}
+
+// userDefinedValue, userMarshalValue, objectInstanceValue and structValue
+// carry a decoded TYPE_USER_DEFINED, TYPE_USER_MARSHAL, TYPE_OBJECT_INSTANCE
+// or TYPE_STRUCT value through assignDynamic.
+type userDefinedValue struct {
+	className string
+	payload   []byte
+}
+
+type userMarshalValue struct {
+	className string
+	wrapped   *MarshalledObject
+}
+
+type objectInstanceValue struct {
+	className string
+	ivars     map[string]interface{}
+}
+
+type structValue struct {
+	className string
+	fields    map[string]interface{}
+}
+
+// cacheObject registers v in the object back-reference table. decodeDynamic
+// calls it for the same values MarshalledObject.cacheObject caches: every
+// value except nil, booleans, Fixnums, symbols and links.
+func (d *Decoder) cacheObject(v interface{}) {
+	d.objects = append(d.objects, v)
+}
+
+// reserveObject claims the next object-cache index before the value that
+// will occupy it has been fully decoded, for values (like a `U` or `o`
+// value) whose link must be visible to a self- or mutually-referential
+// child before that child finishes decoding. Pair with fillReservedObject
+// once the value is built.
+func (d *Decoder) reserveObject() int {
+	idx := len(d.objects)
+	d.objects = append(d.objects, nil)
+	return idx
+}
+
+func (d *Decoder) fillReservedObject(idx int, v interface{}) {
+	d.objects[idx] = v
+}
+
+func (d *Decoder) readInt() (int64, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case b > 0x05 && b < 0xfb:
+		value := int64(b)
+		if value > 0x7f {
+			return -(0xff ^ value + 1) + 5, nil
+		}
+		return value - 5, nil
+
+	case b <= 0x05:
+		bytes := make([]byte, b)
+		if _, err := io.ReadFull(d.r, bytes); err != nil {
+			return 0, err
+		}
+		value := int64(0)
+		for i := len(bytes) - 1; i >= 0; i-- {
+			value = value<<8 + int64(bytes[i])
+		}
+		return value, nil
+
+	default:
+		count := int(0xff-b) + 1
+		bytes := make([]byte, count)
+		if _, err := io.ReadFull(d.r, bytes); err != nil {
+			return 0, err
+		}
+		value := int64(0)
+		for i := len(bytes) - 1; i >= 0; i-- {
+			value = value<<8 + (0xff - int64(bytes[i]))
+		}
+		return -(value + 1), nil
+	}
+}
+
+func (d *Decoder) readString() (string, error) {
+	length, err := d.readInt()
+	if err != nil {
+		return "", err
+	}
+
+	bytes := make([]byte, length)
+	if _, err := io.ReadFull(d.r, bytes); err != nil {
+		return "", err
+	}
+
+	return string(bytes), nil
+}
+
+// assignDynamic stores a value decoded by decodeDynamic into rv, coercing
+// Go's dynamic-decode primitives into whatever concrete type rv requires.
+func assignDynamic(rv reflect.Value, v interface{}) error {
+	if ud, ok := v.(userDefinedValue); ok {
+		if rv.CanAddr() {
+			if u, ok := rv.Addr().Interface().(Unmarshaler); ok {
+				return u.UnmarshalRubyMarshal(ud.payload)
+			}
+		}
+		loader, ok := lookupUserClass(ud.className)
+		if !ok {
+			return fmt.Errorf("gorails/marshal: no registered loader for user-defined class %q", ud.className)
+		}
+		loaded, err := loader(ud.payload)
+		if err != nil {
+			return err
+		}
+		return setReflectValue(rv, loaded)
+	}
+
+	if um, ok := v.(userMarshalValue); ok {
+		loader, ok := lookupUserMarshal(um.className)
+		if !ok {
+			return fmt.Errorf("gorails/marshal: no registered loader for user-marshal class %q", um.className)
+		}
+		loaded, err := loader(um.wrapped)
+		if err != nil {
+			return err
+		}
+		return setReflectValue(rv, loaded)
+	}
+
+	if rv.Kind() == reflect.Interface && rv.NumMethod() == 0 {
+		if v == nil {
+			rv.Set(reflect.Zero(rv.Type()))
+		} else if oi, ok := v.(objectInstanceValue); ok {
+			rv.Set(reflect.ValueOf(oi.ivars))
+		} else if sv, ok := v.(structValue); ok {
+			rv.Set(reflect.ValueOf(sv.fields))
+		} else {
+			rv.Set(reflect.ValueOf(v))
+		}
+		return nil
+	}
+
+	switch value := v.(type) {
+	case nil:
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+
+	case bool:
+		if rv.Kind() != reflect.Bool {
+			return fmt.Errorf("gorails/marshal: cannot decode bool into %s", rv.Type())
+		}
+		rv.SetBool(value)
+		return nil
+
+	case int64:
+		return setNumber(rv, float64(value), value)
+
+	case float64:
+		return setNumber(rv, value, int64(value))
+
+	case *big.Int:
+		return setBignum(rv, value)
+
+	case string:
+		return assignString(rv, value)
+
+	case Symbol:
+		return assignString(rv, string(value))
+
+	case []interface{}:
+		if rv.Kind() != reflect.Slice {
+			return fmt.Errorf("gorails/marshal: cannot decode array into %s", rv.Type())
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(value), len(value))
+		for i, elem := range value {
+			if err := assignDynamic(slice.Index(i), elem); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+		return nil
+
+	case map[string]interface{}:
+		return assignDynamicMap(rv, value)
+
+	case objectInstanceValue:
+		if rv.Kind() != reflect.Struct {
+			return fmt.Errorf("gorails/marshal: cannot decode object into %s", rv.Type())
+		}
+		return assignDynamicStruct(rv, value.ivars)
+
+	case structValue:
+		if rv.Kind() != reflect.Struct {
+			return fmt.Errorf("gorails/marshal: cannot decode struct into %s", rv.Type())
+		}
+		return assignDynamicStruct(rv, value.fields)
+
+	default:
+		return fmt.Errorf("gorails/marshal: cannot decode %T into %s", v, rv.Type())
+	}
+}
+
+func assignString(rv reflect.Value, s string) error {
+	if rv.Kind() != reflect.String {
+		return fmt.Errorf("gorails/marshal: cannot decode string into %s", rv.Type())
+	}
+	rv.SetString(s)
+	return nil
+}
+
+func assignDynamicMap(rv reflect.Value, m map[string]interface{}) error {
+	switch rv.Kind() {
+	case reflect.Map:
+		out := reflect.MakeMapWithSize(rv.Type(), len(m))
+		for k, v := range m {
+			key := reflect.New(rv.Type().Key()).Elem()
+			if err := assignString(key, k); err != nil {
+				return err
+			}
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := assignDynamic(elem, v); err != nil {
+				return err
+			}
+			out.SetMapIndex(key, elem)
+		}
+		rv.Set(out)
+		return nil
+
+	case reflect.Struct:
+		return assignDynamicStruct(rv, m)
+
+	default:
+		return fmt.Errorf("gorails/marshal: cannot decode hash into %s", rv.Type())
+	}
+}
+
+func assignDynamicStruct(rv reflect.Value, fields map[string]interface{}) error {
+	t := rv.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Tag.Get("marshal")
+		if name == "" {
+			name = field.Name
+		}
+
+		value, ok := fields[name]
+		if !ok {
+			value, ok = fields["@"+name]
+		}
+		if !ok {
+			continue
+		}
+
+		if err := assignDynamic(rv.Field(i), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
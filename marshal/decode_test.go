@@ -0,0 +1,188 @@
+package marshal
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+// symbolBytes builds the Marshal encoding of a Symbol, for hand-assembling
+// decoder test fixtures.
+func symbolBytes(name string) []byte {
+	return append([]byte{':', byte(len(name) + 5)}, []byte(name)...)
+}
+
+// TestDecodeUserDefinedConsultsRegistry covers the `u` (TYPE_USER_DEFINED)
+// path: the streaming Decoder must resolve the payload through
+// RegisterUserClass the same way Unmarshal does, rather than handing back
+// the raw dump bytes.
+func TestDecodeUserDefinedConsultsRegistry(t *testing.T) {
+	RegisterUserClass("GorailsTestWidget", func(payload []byte) (interface{}, error) {
+		return "widget:" + string(payload), nil
+	})
+
+	payload := []byte("abc")
+	data := append([]byte{4, 8, 'u'}, symbolBytes("GorailsTestWidget")...)
+	data = append(data, byte(len(payload)+5))
+	data = append(data, payload...)
+
+	var got interface{}
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&got); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got != "widget:abc" {
+		t.Fatalf("Decode() = %v, want %q", got, "widget:abc")
+	}
+}
+
+// TestDecodeUserMarshalConsultsRegistry covers the `U` (TYPE_USER_MARSHAL)
+// path, which decodeDynamic didn't handle at all before: the nested value
+// must be captured as a *MarshalledObject and handed to the registered
+// RegisterUserMarshal loader.
+func TestDecodeUserMarshalConsultsRegistry(t *testing.T) {
+	RegisterUserMarshal("GorailsTestPair", func(wrapped *MarshalledObject) (interface{}, error) {
+		fields, err := wrapped.GetAsArray()
+		if err != nil {
+			return nil, err
+		}
+		a, err := fields[0].GetAsInteger()
+		if err != nil {
+			return nil, err
+		}
+		b, err := fields[1].GetAsInteger()
+		if err != nil {
+			return nil, err
+		}
+		return a + b, nil
+	})
+
+	// U:\x14GorailsTestPair[i3i4 -- class name symbol followed by a nested
+	// [3, 4] array, the shape marshal_dump/marshal_load wrap any value in.
+	data := append([]byte{4, 8, 'U'}, symbolBytes("GorailsTestPair")...)
+	data = append(data, '[', 7, 'i', 8, 'i', 9)
+
+	var got interface{}
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&got); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got != int64(7) {
+		t.Fatalf("Decode() = %v, want 7", got)
+	}
+}
+
+// TestDecodeIVarWrappingNonStringValue covers an `I` (IVAR) wrapper around a
+// non-String value (the format allows it, even though Ruby only emits it for
+// Strings/Regexps in practice): decodeIVar must still consume the trailing
+// (name, value) ivar pairs so the reader stays in sync for what follows,
+// rather than leaving them for the next decodeDynamic call to misread.
+func TestDecodeIVarWrappingNonStringValue(t *testing.T) {
+	data := []byte{4, 8, '[', 7,
+		'I', '[', 7, 'i', 6, 'i', 7, 6, ':', 9, '@', 'f', 'o', 'o', 'T',
+		'i', 7,
+	}
+
+	var got []interface{}
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&got); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Decode() = %v, want 2 elements", got)
+	}
+	array, ok := got[0].([]interface{})
+	if !ok || len(array) != 2 || array[0] != int64(1) || array[1] != int64(2) {
+		t.Fatalf("got[0] = %v, want [1 2]", got[0])
+	}
+	if got[1] != int64(2) {
+		t.Fatalf("got[1] = %v, want 2 (the reader desynced on the ivar pairs)", got[1])
+	}
+}
+
+// TestDecodeCWrappedHash covers the wire format Rails uses for
+// ActiveSupport::HashWithIndifferentAccess (a `C`-wrapped Hash) -- the exact
+// shape of every real Rails session cookie -- through the streaming
+// Decoder, which previously had no case for `C` at all.
+func TestDecodeCWrappedHash(t *testing.T) {
+	// C:'ActiveSupport::HashWithIndifferentAccess'{"foo"=>"bar"}
+	className := "ActiveSupport::HashWithIndifferentAccess"
+	data := append([]byte{4, 8, 'C'}, symbolBytes(className)...)
+	data = append(data, '{', 6, '"', 8, 'f', 'o', 'o', '"', 8, 'b', 'a', 'r')
+
+	var got map[string]string
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&got); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got["foo"] != "bar" {
+		t.Fatalf("Decode() = %v, want map[foo:bar]", got)
+	}
+}
+
+// TestDecodeBignum covers an `l` (TYPE_BIGNUM) value through the streaming
+// Decoder.
+func TestDecodeBignum(t *testing.T) {
+	want := big.NewInt(123456789012345)
+	data := append([]byte{4, 8}, encodeBignumBytes(want)...)
+
+	var got *big.Int
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&got); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got.Cmp(want) != 0 {
+		t.Fatalf("Decode() = %s, want %s", got, want)
+	}
+}
+
+// TestDecodeRepeatedFloatReference covers a back-reference to a Float:
+// unlike strings, arrays and maps, decodeDynamic's `f` case never registered
+// an object-cache slot, so a repeated Float (the exact shape Ruby emits for
+// [3.14, 3.14] -- the second float written as a link to the first) failed
+// to resolve.
+func TestDecodeRepeatedFloatReference(t *testing.T) {
+	// [f3.14, @1]
+	data := []byte{4, 8, '[', 7,
+		'f', 9, '3', '.', '1', '4',
+		'@', 6,
+	}
+
+	var got []interface{}
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&got); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(got) != 2 || got[0] != 3.14 || got[1] != 3.14 {
+		t.Fatalf("Decode() = %v, want [3.14 3.14]", got)
+	}
+}
+
+// TestDecodeUserMarshalThenMoreData confirms decodeUserMarshal's raw-byte
+// tee consumes exactly the nested value's bytes, leaving the reader
+// correctly positioned for whatever follows in the stream.
+func TestDecodeUserMarshalThenMoreData(t *testing.T) {
+	RegisterUserMarshal("GorailsTestPair", func(wrapped *MarshalledObject) (interface{}, error) {
+		fields, err := wrapped.GetAsArray()
+		if err != nil {
+			return nil, err
+		}
+		a, err := fields[0].GetAsInteger()
+		if err != nil {
+			return nil, err
+		}
+		b, err := fields[1].GetAsInteger()
+		if err != nil {
+			return nil, err
+		}
+		return a + b, nil
+	})
+
+	data := append([]byte{4, 8, '['}, 7)
+	data = append(data, 'U')
+	data = append(data, symbolBytes("GorailsTestPair")...)
+	data = append(data, '[', 7, 'i', 8, 'i', 9)
+	data = append(data, 'i', 10)
+
+	var got []interface{}
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&got); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(got) != 2 || got[0] != int64(7) || got[1] != int64(5) {
+		t.Fatalf("Decode() = %v, want [7 5]", got)
+	}
+}
@@ -0,0 +1,287 @@
+package marshal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+// Symbol is a Ruby Symbol (e.g. :foo), as distinct from a Ruby String
+// ("foo"). Encoding a Go string produces a Marshal String; encoding a
+// Symbol produces a Marshal Symbol.
+type Symbol string
+
+// Encoder writes values to an output stream in Ruby's Marshal 4.8 format,
+// maintaining the symbol and object back-reference tables that Ruby's
+// Marshal.dump builds up as it walks an object graph.
+type Encoder struct {
+	w       io.Writer
+	symbols map[string]int64
+	objects map[interface{}]int64
+}
+
+// NewEncoder returns a new Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:       w,
+		symbols: make(map[string]int64),
+		objects: make(map[interface{}]int64),
+	}
+}
+
+// Marshal returns the Marshal 4.8 encoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encode writes the Marshal encoding of v, preceded by the version header.
+func (e *Encoder) Encode(v interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteByte(4)
+	buf.WriteByte(8)
+
+	if err := e.encodeValue(&buf, v); err != nil {
+		return err
+	}
+
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+func (e *Encoder) encodeValue(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		buf.WriteByte('0')
+		return nil
+	case bool:
+		if val {
+			buf.WriteByte('T')
+		} else {
+			buf.WriteByte('F')
+		}
+		return nil
+	case int64:
+		if !fitsFixnum(val) {
+			// A Bignum takes an object-link slot, as Ruby's writer gives it one.
+			e.objects[new(int64)] = int64(len(e.objects))
+			encodeBignum(buf, big.NewInt(val))
+			return nil
+		}
+		buf.WriteByte('i')
+		writeInt(buf, val)
+		return nil
+	case int:
+		return e.encodeValue(buf, int64(val))
+	case float64:
+		// A Float takes an object-link slot, as Ruby's writer gives it one;
+		// it is always written out in full, never as a link.
+		e.objects[new(float64)] = int64(len(e.objects))
+		buf.WriteByte('f')
+		writeString(buf, strconv.FormatFloat(val, 'g', -1, 64))
+		return nil
+	case Symbol:
+		e.encodeSymbol(buf, string(val))
+		return nil
+	case string:
+		return e.encodeObjectOrLink(buf, val, func() error {
+			e.encodeString(buf, val)
+			return nil
+		})
+	case []interface{}:
+		return e.encodeObjectOrLink(buf, val, func() error {
+			return e.encodeArray(buf, val)
+		})
+	case map[string]interface{}:
+		return e.encodeObjectOrLink(buf, val, func() error {
+			return e.encodeMap(buf, val)
+		})
+	default:
+		return fmt.Errorf("gorails/marshal: unsupported type %T", v)
+	}
+}
+
+// encodeObjectOrLink writes an object link (@<index>) if this exact value
+// (by reference identity for slices/maps, by value for strings) has already
+// been written, otherwise registers it in the object cache and runs encode.
+func (e *Encoder) encodeObjectOrLink(buf *bytes.Buffer, v interface{}, encode func() error) error {
+	key := objectCacheKey(v)
+
+	if idx, ok := e.objects[key]; ok {
+		buf.WriteByte('@')
+		writeInt(buf, idx)
+		return nil
+	}
+
+	e.objects[key] = int64(len(e.objects))
+
+	return encode()
+}
+
+// objectCacheKey returns a comparable key that identifies v the way Ruby's
+// object equality would for Marshal back-references: slices and maps are
+// identified by their underlying storage, strings by value.
+func objectCacheKey(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map:
+		return rv.Pointer()
+	default:
+		return v
+	}
+}
+
+func (e *Encoder) encodeSymbol(buf *bytes.Buffer, name string) {
+	if idx, ok := e.symbols[name]; ok {
+		buf.WriteByte(';')
+		writeInt(buf, idx)
+		return
+	}
+
+	e.symbols[name] = int64(len(e.symbols))
+
+	buf.WriteByte(':')
+	writeString(buf, name)
+}
+
+// encodeString writes a Go string as a Ruby String. Every string is
+// wrapped in an IVAR carrying the `E` (encoding) instance variable set to
+// true, matching what Ruby emits for a String with UTF-8 encoding; s is not
+// checked for being valid UTF-8.
+func (e *Encoder) encodeString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('I')
+	buf.WriteByte('"')
+	writeInt(buf, int64(len(s)))
+	buf.WriteString(s)
+
+	writeInt(buf, 1)
+	e.encodeSymbol(buf, "E")
+	buf.WriteByte('T')
+}
+
+func (e *Encoder) encodeArray(buf *bytes.Buffer, arr []interface{}) error {
+	buf.WriteByte('[')
+	writeInt(buf, int64(len(arr)))
+
+	for _, v := range arr {
+		if err := e.encodeValue(buf, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Encoder) encodeMap(buf *bytes.Buffer, m map[string]interface{}) error {
+	buf.WriteByte('{')
+	writeInt(buf, int64(len(m)))
+
+	for k, v := range m {
+		if err := e.encodeValue(buf, k); err != nil {
+			return err
+		}
+		if err := e.encodeValue(buf, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// maxFixnumBytes is the longest byte-length writeInt's length-prefixed
+// branches can produce that parseInt still decodes as a plain integer
+// rather than misreading the header byte as something else: parseInt
+// treats header bytes 0x01-0x05 as "N more bytes follow", so a payload
+// longer than that would silently desync the reader. A value whose
+// magnitude doesn't fit is encoded as a Bignum instead, the way Ruby's own
+// Marshal.dump promotes an Integer too big for a machine word.
+const maxFixnumBytes = 5
+
+// fitsFixnum reports whether value can round-trip through writeInt's 'i'
+// encoding without exceeding maxFixnumBytes.
+func fitsFixnum(value int64) bool {
+	if value >= 0 {
+		n := 0
+		for v := value; v > 0; v >>= 8 {
+			n++
+		}
+		return n <= maxFixnumBytes
+	}
+
+	n := 0
+	for v := value; v < -1; v >>= 8 {
+		n++
+	}
+	return n <= maxFixnumBytes
+}
+
+// encodeBignum writes value using Marshal's `l` (Bignum) format: a sign
+// byte followed by the magnitude as little-endian 16-bit words, the
+// inverse of MarshalledObject.GetAsBignum.
+func encodeBignum(buf *bytes.Buffer, value *big.Int) {
+	sign := byte('+')
+	magnitude := new(big.Int).Abs(value)
+	if value.Sign() < 0 {
+		sign = '-'
+	}
+
+	big_endian := magnitude.Bytes()
+	if len(big_endian)%2 != 0 {
+		big_endian = append([]byte{0}, big_endian...)
+	}
+
+	little_endian := make([]byte, len(big_endian))
+	for i, b := range big_endian {
+		little_endian[len(big_endian)-1-i] = b
+	}
+
+	buf.WriteByte('l')
+	buf.WriteByte(sign)
+	writeInt(buf, int64(len(little_endian)/2))
+	buf.Write(little_endian)
+}
+
+// writeInt writes value using Marshal's compact varint integer encoding,
+// the inverse of parseInt.
+func writeInt(buf *bytes.Buffer, value int64) {
+	switch {
+	case value == 0:
+		buf.WriteByte(0)
+	case value > 0 && value < 123:
+		buf.WriteByte(byte(value + 5))
+	case value < 0 && value > -124:
+		buf.WriteByte(byte(value - 5))
+	case value > 0:
+		bytes := make([]byte, 0, 4)
+		v := value
+		for v > 0 {
+			bytes = append(bytes, byte(v&0xff))
+			v >>= 8
+		}
+		buf.WriteByte(byte(len(bytes)))
+		buf.Write(bytes)
+	default:
+		v := value
+		bytes := make([]byte, 0, 4)
+		for v < -1 {
+			bytes = append(bytes, byte(v&0xff))
+			v >>= 8
+		}
+		buf.WriteByte(byte(0x100 - len(bytes)))
+		buf.Write(bytes)
+	}
+}
+
+// writeString writes a length-prefixed byte sequence: a compact varint
+// length followed by the raw bytes, used for both Marshal strings and
+// symbols.
+func writeString(buf *bytes.Buffer, s string) {
+	writeInt(buf, int64(len(s)))
+	buf.WriteString(s)
+}
@@ -0,0 +1,44 @@
+package marshal
+
+import "testing"
+
+func TestMarshalIntRoundTrip(t *testing.T) {
+	for _, want := range []int64{0, 1, -1, 122, -123, 1000, -1000, 1 << 20, -(1 << 20)} {
+		data, err := Marshal(want)
+		if err != nil {
+			t.Fatalf("Marshal(%d): %v", want, err)
+		}
+		got, err := CreateMarshalledObject(data).GetAsInteger()
+		if err != nil {
+			t.Fatalf("GetAsInteger() after Marshal(%d): %v", want, err)
+		}
+		if got != want {
+			t.Fatalf("round-tripped %d as %d", want, got)
+		}
+	}
+}
+
+// TestMarshalLargeIntUsesBignum covers magnitudes writeInt's 'i' encoding
+// cannot represent (roughly >= 2^40): they must round-trip via the Bignum
+// path rather than silently wrapping to a small, wrong integer.
+func TestMarshalLargeIntUsesBignum(t *testing.T) {
+	for _, want := range []int64{1099511627776, -1099511627777, 9223372036854775807, -9223372036854775808} {
+		data, err := Marshal(want)
+		if err != nil {
+			t.Fatalf("Marshal(%d): %v", want, err)
+		}
+
+		obj := CreateMarshalledObject(data)
+		if obj.GetType() != TYPE_BIGNUM {
+			t.Fatalf("Marshal(%d) produced type %v, want TYPE_BIGNUM", want, obj.GetType())
+		}
+
+		got, err := obj.GetAsBignum()
+		if err != nil {
+			t.Fatalf("GetAsBignum() after Marshal(%d): %v", want, err)
+		}
+		if got.Int64() != want {
+			t.Fatalf("round-tripped %d as %s", want, got)
+		}
+	}
+}
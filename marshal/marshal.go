@@ -41,6 +41,14 @@ const (
 	TYPE_USER_DEFINED       marshalledObjectType = 8
 	TYPE_INSTANCE_VARIABLES marshalledObjectType = 9
 	TYPE_OBJECT_INSTANCE    marshalledObjectType = 10
+	TYPE_BIGNUM             marshalledObjectType = 11
+	TYPE_CLASS              marshalledObjectType = 12
+	TYPE_MODULE             marshalledObjectType = 13
+	TYPE_CLASS_OR_MODULE    marshalledObjectType = 14
+	TYPE_STRUCT             marshalledObjectType = 15
+	TYPE_REGEXP             marshalledObjectType = 16
+	TYPE_DATA               marshalledObjectType = 17
+	TYPE_USER_MARSHAL       marshalledObjectType = 18
 )
 
 func newMarshalledObject(major_version, minor_version byte, data []byte, symbolCache *[]string, objectCache *[]*MarshalledObject) *MarshalledObject {
@@ -91,6 +99,28 @@ func (obj *MarshalledObject) GetType() marshalledObjectType {
 		return TYPE_ARRAY
 	case '{':
 		return TYPE_MAP
+	case 'l':
+		return TYPE_BIGNUM
+	case 'c':
+		return TYPE_CLASS
+	case 'm':
+		return TYPE_MODULE
+	case 'M':
+		return TYPE_CLASS_OR_MODULE
+	case 'S':
+		return TYPE_STRUCT
+	case '/':
+		return TYPE_REGEXP
+	case 'd':
+		return TYPE_DATA
+	case 'U':
+		return TYPE_USER_MARSHAL
+	case 'C', 'e':
+		wrapped, _, err := obj.wrappedValue()
+		if err != nil {
+			return TYPE_UNKNOWN
+		}
+		return wrapped.GetType()
 	}
 
 	return TYPE_UNKNOWN
@@ -134,9 +164,17 @@ func (obj *MarshalledObject) GetAsString() (value string, err error) {
 	if ref := obj.resolveObjectLink(); ref != nil {
 		return ref.GetAsString()
 	}
+	if len(obj.data) > 0 && (obj.data[0] == 'C' || obj.data[0] == 'e') {
+		wrapped, _, err := obj.wrappedValue()
+		if err != nil {
+			return "", err
+		}
+		return wrapped.GetAsString()
+	}
 
-	err = assertType(obj, TYPE_STRING)
-	if err != nil {
+	t := obj.GetType()
+	if t != TYPE_STRING && t != TYPE_CLASS && t != TYPE_MODULE && t != TYPE_CLASS_OR_MODULE {
+		err = TypeMismatch
 		return
 	}
 
@@ -150,7 +188,7 @@ func (obj *MarshalledObject) GetAsString() (value string, err error) {
 		ref_index, _ := parseInt(obj.data[1:])
 		cache := *(obj.symbolCache)
 		value = cache[ref_index]
-	} else if obj.data[0] == '"' {
+	} else if obj.data[0] == '"' || obj.data[0] == 'c' || obj.data[0] == 'm' || obj.data[0] == 'M' {
 		value, _ = parseString(obj.data[1:])
 	} else {
 		value, _, cache = parseStringWithEncoding(obj.data[2:])
@@ -160,68 +198,113 @@ func (obj *MarshalledObject) GetAsString() (value string, err error) {
 	return
 }
 
+// GetAsArray decodes a `[` (Array) value into its elements. An element that
+// is itself a repeated reference to a value appearing earlier in the stream
+// (a Ruby object link) has IsCycle() true, and GetType, GetAsArray,
+// GetAsMap, GetAsString and GetClassName on it transparently resolve and
+// delegate to the very *MarshalledObject that was cached for that value's
+// first occurrence, so cyclic and shared structures can be detected and
+// walked by pointer identity. The other accessors (GetAsFloat, GetAsBignum,
+// GetAsStruct, GetAsRegexp, ...) do not resolve links.
 func (obj *MarshalledObject) GetAsArray() (value []*MarshalledObject, err error) {
 	if ref := obj.resolveObjectLink(); ref != nil {
 		return ref.GetAsArray()
 	}
 
-	err = assertType(obj, TYPE_ARRAY)
+	// A C/e-wrapped Array shares its Ruby object link with its wrapped
+	// payload -- Ruby's writer assigns exactly one link to the wrapped
+	// value, tag and all -- so obj, not the unwrapped core, is what must be
+	// cached below; decoding the elements out of core directly (rather than
+	// delegating to core.GetAsArray(), which would cache core itself) keeps
+	// that one link pointed at obj.
+	core := obj
+	name_size := 0
+	if len(obj.data) > 0 && (obj.data[0] == 'C' || obj.data[0] == 'e') {
+		wrapped, wrapped_name_size, err := obj.wrappedValue()
+		if err != nil {
+			return nil, err
+		}
+		core, name_size = wrapped, wrapped_name_size
+	}
+
+	err = assertType(core, TYPE_ARRAY)
 	if err != nil {
 		return
 	}
 
 	obj.cacheObject(obj)
 
-	array_size, offset := parseInt(obj.data[1:])
+	array_size, offset := parseInt(core.data[1:])
 	offset += 1
 
 	value = make([]*MarshalledObject, array_size)
 	for i := int64(0); i < array_size; i++ {
-		value_size, err := newMarshalledObjectWithSize(
-			obj.MajorVersion,
-			obj.MinorVersion,
-			obj.data[offset:],
-			0,
-			obj.symbolCache,
-			obj.objectCache,
-		).getSize()
+		elem := newMarshalledObject(
+			core.MajorVersion,
+			core.MinorVersion,
+			core.data[offset:],
+			core.symbolCache,
+			core.objectCache,
+		)
+		// Register elem's cache slot, if it gets one, before descending
+		// into its contents, mirroring the order Ruby's writer assigns
+		// object links in.
+		obj.cacheObject(elem)
 
+		elem_size, err := elem.getSize()
 		if err != nil {
 			return nil, err
 		}
+		elem.data = elem.data[:elem_size]
 
-		value[i] = newMarshalledObject(
-			obj.MajorVersion,
-			obj.MinorVersion,
-			obj.data[offset:offset+value_size],
-			obj.symbolCache,
-			obj.objectCache,
-		)
-		obj.cacheObject(value[i])
-		offset += value_size
+		value[i] = elem
+		offset += elem_size
 	}
 
-	obj.size = offset
+	core.size = offset
+	if core != obj {
+		obj.size = 1 + name_size + offset
+	}
 
 	return
 }
 
+// GetAsMap decodes a `{` (Hash) value into a map keyed by each key's string
+// form. As with GetAsArray, a value that is a repeated reference to an
+// earlier object in the stream has IsCycle() true and delegates to that
+// earlier object's *MarshalledObject rather than decoding a fresh copy.
 func (obj *MarshalledObject) GetAsMap() (value map[string]*MarshalledObject, err error) {
 	if ref := obj.resolveObjectLink(); ref != nil {
 		return ref.GetAsMap()
 	}
 
-	err = assertType(obj, TYPE_MAP)
+	// See the matching comment in GetAsArray: a C/e-wrapped Hash shares its
+	// Ruby object link with its wrapped payload, so obj (not the unwrapped
+	// core) is what gets cached below, before getMaplike parses core.
+	core := obj
+	name_size := 0
+	if len(obj.data) > 0 && (obj.data[0] == 'C' || obj.data[0] == 'e') {
+		wrapped, wrapped_name_size, err := obj.wrappedValue()
+		if err != nil {
+			return nil, err
+		}
+		core, name_size = wrapped, wrapped_name_size
+	}
+
+	err = assertType(core, TYPE_MAP)
 	if err != nil {
 		return
 	}
 
 	obj.cacheObject(obj)
 
-	pairs, err := obj.getMaplike(true)
+	pairs, err := core.getMaplike(true)
 	if err != nil {
 		return
 	}
+	if core != obj {
+		obj.size = 1 + name_size + core.size
+	}
 
 	value = make(map[string]*MarshalledObject, len(pairs))
 	for k, v := range pairs {
@@ -243,6 +326,9 @@ func (obj *MarshalledObject) getMaplike(hasType bool) (value map[*MarshalledObje
 
 	value = make(map[*MarshalledObject]*MarshalledObject, map_size)
 	for i := int64(0); i < map_size; i++ {
+		// Both key and value get their cache slot, if any, before their
+		// contents are parsed, mirroring the order Ruby's writer assigns
+		// object links in.
 		k := newMarshalledObject(
 			obj.MajorVersion,
 			obj.MinorVersion,
@@ -255,29 +341,22 @@ func (obj *MarshalledObject) getMaplike(hasType bool) (value map[*MarshalledObje
 		if err != nil {
 			return nil, err
 		}
+		k.data = k.data[:key_size]
 		offset += key_size
 
-		value_size, err := newMarshalledObjectWithSize(
+		v := newMarshalledObject(
 			obj.MajorVersion,
 			obj.MinorVersion,
 			obj.data[offset:],
-			0,
 			obj.symbolCache,
 			obj.objectCache,
-		).getSize()
-
+		)
+		obj.cacheObject(v)
+		value_size, err := v.getSize()
 		if err != nil {
 			return nil, err
 		}
-
-		v := newMarshalledObject(
-			obj.MajorVersion,
-			obj.MinorVersion,
-			obj.data[offset:offset+value_size],
-			obj.symbolCache,
-			obj.objectCache,
-		)
-		obj.cacheObject(v)
+		v.data = v.data[:value_size]
 		value[k] = v
 
 		offset += value_size
@@ -288,6 +367,101 @@ func (obj *MarshalledObject) getMaplike(hasType bool) (value map[*MarshalledObje
 	return
 }
 
+// GetAsInstanceVariables returns the wrapped object together with the
+// instance variables Ruby attached to it (e.g. the `@E` encoding flag on a
+// String). Symbol ivar names keep their leading `@`.
+func (obj *MarshalledObject) GetAsInstanceVariables() (wrapped *MarshalledObject, ivars map[string]*MarshalledObject, err error) {
+	err = assertType(obj, TYPE_INSTANCE_VARIABLES)
+	if err != nil {
+		return
+	}
+
+	obj.cacheObject(obj)
+
+	wrapped = newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1:], obj.symbolCache, obj.objectCache)
+	obj.cacheObject(wrapped)
+	wrapped_len, err := wrapped.getSize()
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped.data = wrapped.data[:wrapped_len]
+
+	ivars_obj := newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1+wrapped_len:], obj.symbolCache, obj.objectCache)
+	pairs, err := ivars_obj.getMaplike(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj.size = 1 + wrapped_len + ivars_obj.size
+
+	ivars = make(map[string]*MarshalledObject, len(pairs))
+	for k, v := range pairs {
+		ivars[k.ToString()] = v
+	}
+
+	return
+}
+
+// GetAsObjectInstance returns the Ruby class name and instance variables of
+// an `o` (object) value, e.g. a plain `User.new` serialized by Marshal.
+func (obj *MarshalledObject) GetAsObjectInstance() (className string, ivars map[string]*MarshalledObject, err error) {
+	err = assertType(obj, TYPE_OBJECT_INSTANCE)
+	if err != nil {
+		return
+	}
+
+	obj.cacheObject(obj)
+
+	class_name := newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1:], obj.symbolCache, obj.objectCache)
+	className, err = class_name.GetAsString()
+	if err != nil {
+		return "", nil, err
+	}
+	class_name_len, err := class_name.getSize()
+	if err != nil {
+		return "", nil, err
+	}
+
+	ivars_obj := newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1+class_name_len:], obj.symbolCache, obj.objectCache)
+	pairs, err := ivars_obj.getMaplike(false)
+	if err != nil {
+		return "", nil, err
+	}
+	obj.size = 1 + class_name_len + ivars_obj.size
+
+	ivars = make(map[string]*MarshalledObject, len(pairs))
+	for k, v := range pairs {
+		ivars[k.ToString()] = v
+	}
+
+	return
+}
+
+// GetAsUserDefined returns the Ruby class name and opaque `_dump` byte
+// payload of a `u` (TYPE_USER_DEFINED) value. Use RegisterUserClass to teach
+// the package how to turn that payload into a usable Go value.
+func (obj *MarshalledObject) GetAsUserDefined() (className string, payload []byte, err error) {
+	err = assertType(obj, TYPE_USER_DEFINED)
+	if err != nil {
+		return
+	}
+
+	class_name := newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1:], obj.symbolCache, obj.objectCache)
+	className, err = class_name.GetAsString()
+	if err != nil {
+		return "", nil, err
+	}
+	class_name_len, err := class_name.getSize()
+	if err != nil {
+		return "", nil, err
+	}
+
+	payload_len, int_len := parseInt(obj.data[1+class_name_len:])
+	start := 1 + class_name_len + int_len
+	payload = obj.data[start : start+int(payload_len)]
+
+	return
+}
+
 func assertType(obj *MarshalledObject, expected_type marshalledObjectType) (err error) {
 	if obj.GetType() != expected_type {
 		err = TypeMismatch
@@ -305,6 +479,38 @@ func (obj *MarshalledObject) getSize() (size int, err error) {
 		return header_size + data_size, nil
 	}
 
+	if len(obj.data) > 0 && (obj.data[0] == 'C' || obj.data[0] == 'e') {
+		wrapped, name_len, err := obj.wrappedValue()
+		if err != nil {
+			return 0, err
+		}
+
+		// A wrapped Array/Hash is sized by decoding it, same as an
+		// unwrapped one below, and decoding is also where the object cache
+		// gets populated -- so this must go through obj's own GetAsArray/
+		// GetAsMap (which caches obj, the value Ruby actually linked) rather
+		// than wrapped.getSize() recursing into wrapped.GetAsArray/GetAsMap
+		// and caching the unwrapped payload under the wrong pointer.
+		switch wrapped.GetType() {
+		case TYPE_ARRAY:
+			if _, err := obj.GetAsArray(); err != nil {
+				return 0, err
+			}
+			return obj.size, nil
+		case TYPE_MAP:
+			if _, err := obj.GetAsMap(); err != nil {
+				return 0, err
+			}
+			return obj.size, nil
+		}
+
+		wrapped_len, err := wrapped.getSize()
+		if err != nil {
+			return 0, err
+		}
+		return 1 + name_len + wrapped_len, nil
+	}
+
 	switch obj.GetType() {
 	case TYPE_NIL, TYPE_BOOL:
 		header_size = 0
@@ -349,7 +555,7 @@ func (obj *MarshalledObject) getSize() (size int, err error) {
 		header_size = 1
 		data_size = class_name_len + int_length + int(sequence_length)
 
-	case TYPE_INSTANCE_VARIABLES, TYPE_OBJECT_INSTANCE:
+	case TYPE_INSTANCE_VARIABLES, TYPE_OBJECT_INSTANCE, TYPE_STRUCT:
 		main_obj := newMarshalledObject(
 			obj.MajorVersion,
 			obj.MinorVersion,
@@ -374,24 +580,57 @@ func (obj *MarshalledObject) getSize() (size int, err error) {
 		}
 		header_size = 1
 		data_size = main_obj_len + ivars.size
+	case TYPE_BIGNUM:
+		header_size = 2
+		size, int_len := parseInt(obj.data[2:])
+		data_size = int_len + int(size)*2
+	case TYPE_CLASS, TYPE_MODULE, TYPE_CLASS_OR_MODULE:
+		header_size = 1
+		_, data_size = parseString(obj.data[header_size:])
+	case TYPE_REGEXP:
+		header_size = 1
+		_, str_len := parseString(obj.data[header_size:])
+		data_size = str_len + 1
+	case TYPE_DATA, TYPE_USER_MARSHAL:
+		class_name := newMarshalledObject(
+			obj.MajorVersion,
+			obj.MinorVersion,
+			obj.data[1:],
+			obj.symbolCache,
+			obj.objectCache,
+		)
+		class_name_len, err := class_name.getSize()
+		if err != nil {
+			return 0, err
+		}
+		wrapped := newMarshalledObject(
+			obj.MajorVersion,
+			obj.MinorVersion,
+			obj.data[1+class_name_len:],
+			obj.symbolCache,
+			obj.objectCache,
+		)
+		wrapped_len, err := wrapped.getSize()
+		if err != nil {
+			return 0, err
+		}
+		header_size = 1
+		data_size = class_name_len + wrapped_len
 	case TYPE_ARRAY:
-		if obj.size == 0 {
-			_, err := obj.GetAsArray()
-			if err != nil {
-				return 0, err
-			} else {
-				return obj.size, nil
-			}
+		// A freshly constructed object starts with size set to the full
+		// length of the remaining buffer, not its own true size, so that
+		// can't be used to tell whether this array has already been
+		// measured; GetAsArray is idempotent (its own cacheObject call
+		// de-duplicates by pointer) so it's safe to call unconditionally.
+		if _, err := obj.GetAsArray(); err != nil {
+			return 0, err
 		}
+		return obj.size, nil
 	case TYPE_MAP:
-		if obj.size == 0 {
-			_, err := obj.GetAsMap()
-			if err != nil {
-				return 0, err
-			} else {
-				return obj.size, nil
-			}
+		if _, err := obj.GetAsMap(); err != nil {
+			return 0, err
 		}
+		return obj.size, nil
 	case TYPE_UNKNOWN:
 		return 0, UnsupportedType{obj.data[0]}
 	}
@@ -422,11 +661,21 @@ func (obj *MarshalledObject) cacheSymbols(symbols ...string) {
 	*(obj.symbolCache) = cache
 }
 
+// cacheObject registers object in the shared object back-reference table,
+// unless it is a value Ruby never assigns an object link to (nil, a
+// boolean, an integer, a symbol, or an existing link itself) or it is
+// already present. This mirrors Ruby's Marshal writer, which hands out one
+// link per object the first time it's written and reuses that link for
+// every subsequent reference to the same object.
 func (obj *MarshalledObject) cacheObject(object *MarshalledObject) {
-	if len(object.data) > 0 && (object.data[0] == '@' || object.data[0] == ':' || object.data[0] == ';') {
+	if len(object.data) == 0 {
 		return
 	}
-	if t := obj.GetType(); !(t == TYPE_STRING || t == TYPE_ARRAY || t == TYPE_MAP) {
+	if object.data[0] == '@' || object.data[0] == ':' || object.data[0] == ';' {
+		return
+	}
+	switch object.GetType() {
+	case TYPE_NIL, TYPE_BOOL, TYPE_INTEGER, TYPE_UNKNOWN:
 		return
 	}
 
@@ -480,6 +729,17 @@ func (obj *MarshalledObject) resolveObjectLink() *MarshalledObject {
 	return nil
 }
 
+// IsCycle reports whether obj is itself an object link (`@<index>`) — a
+// back-reference to a value that was already written earlier in the same
+// Marshal stream, rather than that value's own first occurrence. Every
+// method that resolves a link (GetAsArray, GetAsMap, GetAsString, etc.)
+// does so transparently and returns the same *MarshalledObject the link
+// points at, so IsCycle is the only way to tell a repeated reference from
+// a value that merely happens to be equal.
+func (obj *MarshalledObject) IsCycle() bool {
+	return len(obj.data) > 0 && obj.data[0] == '@'
+}
+
 func parseBool(data []byte) (bool, int) {
 	return data[0] == 'T', 1
 }
@@ -0,0 +1,145 @@
+package marshal
+
+import "testing"
+
+// TestSelfReferentialArray covers a Ruby `a = []; a << a` object graph: the
+// array's sole element is a link back to the array itself.
+func TestSelfReferentialArray(t *testing.T) {
+	a := make([]interface{}, 1)
+	a[0] = a
+
+	data, err := Marshal(a)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	obj := CreateMarshalledObject(data)
+	arr, err := obj.GetAsArray()
+	if err != nil {
+		t.Fatalf("GetAsArray: %v", err)
+	}
+	if len(arr) != 1 {
+		t.Fatalf("len(arr) = %d, want 1", len(arr))
+	}
+	if !arr[0].IsCycle() {
+		t.Fatal("arr[0].IsCycle() = false, want true")
+	}
+	if arr[0].resolveObjectLink() != obj {
+		t.Fatal("arr[0] does not resolve back to the root array")
+	}
+}
+
+// TestMutuallyRecursiveHashes covers two hashes that each hold a reference
+// to the other: h1 = {}; h2 = {}; h1["other"] = h2; h2["other"] = h1.
+func TestMutuallyRecursiveHashes(t *testing.T) {
+	h1 := map[string]interface{}{}
+	h2 := map[string]interface{}{}
+	h1["other"] = h2
+	h2["other"] = h1
+
+	data, err := Marshal(h1)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	obj := CreateMarshalledObject(data)
+	outer, err := obj.GetAsMap()
+	if err != nil {
+		t.Fatalf("GetAsMap: %v", err)
+	}
+
+	inner, err := outer["other"].GetAsMap()
+	if err != nil {
+		t.Fatalf("GetAsMap on h2: %v", err)
+	}
+
+	link := inner["other"]
+	if !link.IsCycle() {
+		t.Fatal("inner[\"other\"].IsCycle() = false, want true")
+	}
+	if link.resolveObjectLink() != obj {
+		t.Fatal("inner[\"other\"] does not resolve back to h1")
+	}
+}
+
+// TestRepeatedStringReference covers an array holding the same String
+// object twice: the second occurrence is encoded as a link, not a copy.
+func TestRepeatedStringReference(t *testing.T) {
+	s := "shared"
+	data, err := Marshal([]interface{}{s, s})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	obj := CreateMarshalledObject(data)
+	arr, err := obj.GetAsArray()
+	if err != nil {
+		t.Fatalf("GetAsArray: %v", err)
+	}
+	if len(arr) != 2 {
+		t.Fatalf("len(arr) = %d, want 2", len(arr))
+	}
+	if arr[0].IsCycle() {
+		t.Fatal("arr[0].IsCycle() = true, want false (first occurrence)")
+	}
+	if !arr[1].IsCycle() {
+		t.Fatal("arr[1].IsCycle() = false, want true (repeated reference)")
+	}
+
+	first, err := arr[0].GetAsString()
+	if err != nil {
+		t.Fatalf("GetAsString(arr[0]): %v", err)
+	}
+	second, err := arr[1].GetAsString()
+	if err != nil {
+		t.Fatalf("GetAsString(arr[1]): %v", err)
+	}
+	if first != "shared" || second != "shared" {
+		t.Fatalf("got %q, %q, want \"shared\", \"shared\"", first, second)
+	}
+	if arr[1].resolveObjectLink() != arr[0] {
+		t.Fatal("arr[1] does not resolve back to arr[0]")
+	}
+}
+
+// TestNestedArraysGetSizedCorrectly covers an array of arrays, exercising
+// getSize's recursive sizing of a non-link container element that isn't the
+// last value in the buffer.
+func TestNestedArraysGetSizedCorrectly(t *testing.T) {
+	data, err := Marshal([]interface{}{
+		[]interface{}{int64(1), int64(2)},
+		[]interface{}{int64(3), int64(4)},
+	})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	obj := CreateMarshalledObject(data)
+	arr, err := obj.GetAsArray()
+	if err != nil {
+		t.Fatalf("GetAsArray: %v", err)
+	}
+	if len(arr) != 2 {
+		t.Fatalf("len(arr) = %d, want 2", len(arr))
+	}
+
+	want := [][]int64{{1, 2}, {3, 4}}
+	for i, elem := range arr {
+		inner, err := elem.GetAsArray()
+		if err != nil {
+			t.Fatalf("GetAsArray(arr[%d]): %v", i, err)
+		}
+		if len(inner) != len(want[i]) {
+			t.Fatalf("len(arr[%d]) = %d, want %d", i, len(inner), len(want[i]))
+		}
+		for j, v := range inner {
+			n, err := v.GetAsInteger()
+			if err != nil {
+				t.Fatalf("GetAsInteger(arr[%d][%d]): %v", i, j, err)
+			}
+			if n != want[i][j] {
+				t.Fatalf("arr[%d][%d] = %d, want %d", i, j, n, want[i][j])
+			}
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package marshal
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// RegisterUserClass teaches the package how to turn the opaque `_dump`
+// payload of Ruby class name into a usable Go value. Unmarshal and
+// Decoder.Decode consult this registry whenever they reach a `u`
+// (TYPE_USER_DEFINED) value whose target doesn't itself implement
+// Unmarshaler.
+func RegisterUserClass(name string, loader func([]byte) (interface{}, error)) {
+	userClassRegistry.Lock()
+	defer userClassRegistry.Unlock()
+	userClassRegistry.loaders[name] = loader
+}
+
+func lookupUserClass(name string) (func([]byte) (interface{}, error), bool) {
+	userClassRegistry.RLock()
+	defer userClassRegistry.RUnlock()
+	loader, ok := userClassRegistry.loaders[name]
+	return loader, ok
+}
+
+// RegisterUserMarshal teaches the package how to turn the wrapped value of a
+// Ruby class's marshal_dump into a usable Go value. Unmarshal consults this
+// registry whenever it reaches a `U` (TYPE_USER_MARSHAL) value.
+func RegisterUserMarshal(name string, loader func(*MarshalledObject) (interface{}, error)) {
+	userMarshalRegistry.Lock()
+	defer userMarshalRegistry.Unlock()
+	userMarshalRegistry.loaders[name] = loader
+}
+
+func lookupUserMarshal(name string) (func(*MarshalledObject) (interface{}, error), bool) {
+	userMarshalRegistry.RLock()
+	defer userMarshalRegistry.RUnlock()
+	loader, ok := userMarshalRegistry.loaders[name]
+	return loader, ok
+}
+
+var userClassRegistry = struct {
+	sync.RWMutex
+	loaders map[string]func([]byte) (interface{}, error)
+}{loaders: make(map[string]func([]byte) (interface{}, error))}
+
+var userMarshalRegistry = struct {
+	sync.RWMutex
+	loaders map[string]func(*MarshalledObject) (interface{}, error)
+}{loaders: make(map[string]func(*MarshalledObject) (interface{}, error))}
+
+func init() {
+	RegisterUserClass("Time", loadTime)
+	RegisterUserClass("BigDecimal", loadBigDecimal)
+	RegisterUserMarshal("Date", loadDate)
+	RegisterUserMarshal("DateTime", loadDate)
+	RegisterUserMarshal("ActiveSupport::TimeWithZone", loadTimeWithZone)
+
+	// ActiveSupport::HashWithIndifferentAccess has no entry here: Rails
+	// dumps it as a plain `C`-wrapped Hash (TYPE_MAP with a class name),
+	// not via marshal_dump/_dump, so it never reaches userClassRegistry or
+	// userMarshalRegistry. GetAsMap/GetAsArray/GetAsString already unwrap
+	// any `C` value transparently (see wrappedValue), so it and other Hash
+	// or Array subclasses decode correctly with no loader required.
+}
+
+// loadTime decodes the 8-byte payload Ruby's Time#_dump produces: a 4-byte
+// big-endian word packing a "new format" flag, a UTC flag, year/month/day/
+// hour, followed by a 4-byte big-endian word packing minute/second/usec.
+func loadTime(payload []byte) (interface{}, error) {
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("gorails/marshal: invalid Time payload (%d bytes)", len(payload))
+	}
+
+	high := uint32(payload[0])<<24 | uint32(payload[1])<<16 | uint32(payload[2])<<8 | uint32(payload[3])
+	low := uint32(payload[4])<<24 | uint32(payload[5])<<16 | uint32(payload[6])<<8 | uint32(payload[7])
+
+	if high&(1<<31) == 0 {
+		sec := int32(high)
+		usec := int32(low)
+		return time.Unix(int64(sec), int64(usec)*1000).UTC(), nil
+	}
+
+	utc := (high>>30)&0x1 == 1
+	year := int((high>>14)&0xffff) + 1900
+	month := time.Month((high>>10)&0xf) + 1
+	day := int((high >> 5) & 0x1f)
+	hour := int(high & 0x1f)
+	min := int((low >> 26) & 0x3f)
+	sec := int((low >> 20) & 0x3f)
+	usec := int(low & 0xfffff)
+
+	loc := time.Local
+	if utc {
+		loc = time.UTC
+	}
+
+	return time.Date(year, month, day, hour, min, sec, usec*1000, loc), nil
+}
+
+// loadBigDecimal decodes the "<significant digits>:<value>" string format
+// BigDecimal#_dump produces into an arbitrary-precision float.
+func loadBigDecimal(payload []byte) (interface{}, error) {
+	str := string(payload)
+	for i, c := range str {
+		if c == ':' {
+			value, ok := new(big.Float).SetString(str[i+1:])
+			if !ok {
+				return nil, fmt.Errorf("gorails/marshal: invalid BigDecimal payload %q", str)
+			}
+			return value, nil
+		}
+	}
+
+	return nil, fmt.Errorf("gorails/marshal: invalid BigDecimal payload %q", str)
+}
+
+// loadDate decodes the [ajd, offset, start] array Date#marshal_dump (and
+// DateTime#marshal_dump) produce, where ajd is the astronomical Julian day
+// as a Rational and offset is the UTC offset in days as a Rational. It
+// returns the equivalent time.Time at midnight UTC of the corresponding
+// calendar day; any sub-day part carried by a DateTime's ajd is dropped.
+func loadDate(obj *MarshalledObject) (interface{}, error) {
+	fields, err := obj.GetAsArray()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("gorails/marshal: invalid Date payload")
+	}
+
+	ajd, err := decodeRational(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	offset, err := decodeRational(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert the astronomical Julian day back to a civil Julian day
+	// number (Date.jd) by undoing the offset and the half-day shift.
+	jd := new(big.Rat).Add(ajd, offset)
+	jd.Add(jd, big.NewRat(1, 2))
+
+	jdFloat, _ := jd.Float64()
+	return julianDayToTime(jdFloat), nil
+}
+
+// loadTimeWithZone decodes the [utc, zone, time] array
+// ActiveSupport::TimeWithZone#marshal_dump produces, returning the UTC
+// instant as a time.Time.
+func loadTimeWithZone(obj *MarshalledObject) (interface{}, error) {
+	fields, err := obj.GetAsArray()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 1 {
+		return nil, fmt.Errorf("gorails/marshal: invalid ActiveSupport::TimeWithZone payload")
+	}
+
+	className, err := fields[0].GetClassName()
+	if err != nil {
+		return nil, err
+	}
+	if className != "Time" {
+		return nil, fmt.Errorf("gorails/marshal: unexpected ActiveSupport::TimeWithZone utc class %q", className)
+	}
+
+	_, payload, err := fields[0].GetAsUserDefined()
+	if err != nil {
+		return nil, err
+	}
+
+	return loadTime(payload)
+}
+
+// decodeRational decodes the [numerator, denominator] array Rational
+// (itself marshaled via marshal_dump) produces.
+func decodeRational(obj *MarshalledObject) (*big.Rat, error) {
+	className, err := obj.GetClassName()
+	if err != nil {
+		return nil, err
+	}
+	if className != "Rational" {
+		return nil, fmt.Errorf("gorails/marshal: expected Rational, got %q", className)
+	}
+
+	_, wrapped, err := obj.userMarshalPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := wrapped.GetAsArray()
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("gorails/marshal: invalid Rational payload")
+	}
+
+	num, err := parts[0].GetAsInteger()
+	if err != nil {
+		return nil, err
+	}
+	den, err := parts[1].GetAsInteger()
+	if err != nil {
+		return nil, err
+	}
+
+	return big.NewRat(num, den), nil
+}
+
+// julianDayToTime converts a civil Julian day number to the UTC midnight of
+// the corresponding proleptic-Gregorian calendar date, using the standard
+// Fliegel & Van Flandern algorithm.
+func julianDayToTime(jd float64) time.Time {
+	l := int64(jd) + 68569
+	n := 4 * l / 146097
+	l = l - (146097*n+3)/4
+	i := 4000 * (l + 1) / 1461001
+	l = l - 1461*i/4 + 31
+	j := 80 * l / 2447
+	day := l - 2447*j/80
+	l = j / 11
+	month := j + 2 - 12*l
+	year := 100*(n-49) + i + l
+
+	return time.Date(int(year), time.Month(month), int(day), 0, 0, 0, 0, time.UTC)
+}
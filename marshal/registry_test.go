@@ -0,0 +1,57 @@
+package marshal
+
+import (
+	"testing"
+	"time"
+)
+
+// packTimeDump builds the 8-byte payload Time#_dump's "new format" produces,
+// mirroring loadTime's own bit layout so the test doesn't depend on a
+// separate encoder for Ruby's Time.
+func packTimeDump(utc bool, year, month, day, hour, min, sec, usec int) []byte {
+	high := uint32(1) << 31
+	if utc {
+		high |= 1 << 30
+	}
+	high |= uint32(year-1900) << 14
+	high |= uint32(month-1) << 10
+	high |= uint32(day) << 5
+	high |= uint32(hour)
+
+	low := uint32(min)<<26 | uint32(sec)<<20 | uint32(usec)
+
+	return []byte{
+		byte(high >> 24), byte(high >> 16), byte(high >> 8), byte(high),
+		byte(low >> 24), byte(low >> 16), byte(low >> 8), byte(low),
+	}
+}
+
+func TestLoadTime(t *testing.T) {
+	payload := packTimeDump(true, 2023, 6, 15, 10, 30, 0, 0)
+
+	value, err := loadTime(payload)
+	if err != nil {
+		t.Fatalf("loadTime: %v", err)
+	}
+	got := value.(time.Time)
+
+	want := time.Date(2023, time.June, 15, 10, 30, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Fatalf("loadTime() = %v, want %v", got, want)
+	}
+}
+
+func TestLoadTimeJanuaryDoesNotUnderflowToPriorYear(t *testing.T) {
+	payload := packTimeDump(true, 2024, 1, 1, 0, 0, 0, 0)
+
+	value, err := loadTime(payload)
+	if err != nil {
+		t.Fatalf("loadTime: %v", err)
+	}
+	got := value.(time.Time)
+
+	want := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Fatalf("loadTime() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+package marshal
+
+import "math/big"
+
+// wrappedValue peels the class/module-name symbol off a `C` (user-class
+// wrapped built-in) or `e` (module-extended object) value and returns the
+// object it wraps, along with the byte length the name symbol occupied.
+func (obj *MarshalledObject) wrappedValue() (wrapped *MarshalledObject, name_size int, err error) {
+	name := newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1:], obj.symbolCache, obj.objectCache)
+	name_size, err = name.getSize()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	wrapped = newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1+name_size:], obj.symbolCache, obj.objectCache)
+
+	return
+}
+
+// userMarshalPayload returns the Ruby class name and wrapped value of a `U`
+// (marshal_dump/marshal_load) value.
+func (obj *MarshalledObject) userMarshalPayload() (className string, wrapped *MarshalledObject, err error) {
+	err = assertType(obj, TYPE_USER_MARSHAL)
+	if err != nil {
+		return
+	}
+
+	wrapped, name_size, err := obj.wrappedValue()
+	if err != nil {
+		return "", nil, err
+	}
+
+	class_name := newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1:1+name_size], obj.symbolCache, obj.objectCache)
+	className, err = class_name.GetAsString()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return
+}
+
+// GetAsData returns the Ruby class name and wrapped value of a `d`
+// (_dump_data/_load_data) value. The wire layout is identical to `U`
+// (TYPE_USER_MARSHAL); Ruby just uses it for the older Data protocol, so
+// lookupUserMarshal's registry serves both.
+func (obj *MarshalledObject) GetAsData() (className string, wrapped *MarshalledObject, err error) {
+	err = assertType(obj, TYPE_DATA)
+	if err != nil {
+		return
+	}
+
+	wrapped, name_size, err := obj.wrappedValue()
+	if err != nil {
+		return "", nil, err
+	}
+
+	class_name := newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1:1+name_size], obj.symbolCache, obj.objectCache)
+	className, err = class_name.GetAsString()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return
+}
+
+// GetAsBignum decodes an `l` (Bignum) value into an arbitrary-precision
+// integer.
+func (obj *MarshalledObject) GetAsBignum() (value *big.Int, err error) {
+	err = assertType(obj, TYPE_BIGNUM)
+	if err != nil {
+		return
+	}
+
+	sign := obj.data[1]
+	word_count, offset := parseInt(obj.data[2:])
+	raw := obj.data[2+offset : 2+offset+int(word_count)*2]
+
+	// Marshal stores the magnitude as little-endian 16-bit words;
+	// big.Int.SetBytes wants big-endian bytes.
+	big_endian := make([]byte, len(raw))
+	for i, b := range raw {
+		big_endian[len(raw)-1-i] = b
+	}
+
+	value = new(big.Int).SetBytes(big_endian)
+	if sign == '-' {
+		value.Neg(value)
+	}
+
+	return
+}
+
+// GetAsRegexp decodes a `/` (Regexp) value into its source pattern and the
+// raw Ruby options byte (ONIG_OPTION_IGNORECASE | ONIG_OPTION_EXTEND |
+// ONIG_OPTION_MULTILINE).
+func (obj *MarshalledObject) GetAsRegexp() (pattern string, opts byte, err error) {
+	err = assertType(obj, TYPE_REGEXP)
+	if err != nil {
+		return
+	}
+
+	pattern, str_size := parseString(obj.data[1:])
+	opts = obj.data[1+str_size]
+
+	return
+}
+
+// GetAsStruct decodes an `S` (Struct) value into its class name and a map
+// of member name to value.
+func (obj *MarshalledObject) GetAsStruct() (name string, fields map[string]*MarshalledObject, err error) {
+	err = assertType(obj, TYPE_STRUCT)
+	if err != nil {
+		return
+	}
+
+	obj.cacheObject(obj)
+
+	class_name := newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1:], obj.symbolCache, obj.objectCache)
+	name, err = class_name.GetAsString()
+	if err != nil {
+		return "", nil, err
+	}
+	class_name_len, err := class_name.getSize()
+	if err != nil {
+		return "", nil, err
+	}
+
+	members := newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1+class_name_len:], obj.symbolCache, obj.objectCache)
+	pairs, err := members.getMaplike(false)
+	if err != nil {
+		return "", nil, err
+	}
+	obj.size = 1 + class_name_len + members.size
+
+	fields = make(map[string]*MarshalledObject, len(pairs))
+	for k, v := range pairs {
+		fields[k.ToString()] = v
+	}
+
+	return
+}
+
+// GetClassName returns the Ruby class (or module) name carried by an `o`
+// (object instance), `u` (user-defined), `U` (user-marshal), `C`
+// (user-class-wrapped built-in) or `e` (module-extended) value.
+func (obj *MarshalledObject) GetClassName() (string, error) {
+	if ref := obj.resolveObjectLink(); ref != nil {
+		return ref.GetClassName()
+	}
+
+	if len(obj.data) == 0 {
+		return "", UnsupportedType{0}
+	}
+
+	switch obj.data[0] {
+	case 'o':
+		name, _, err := obj.GetAsObjectInstance()
+		return name, err
+	case 'u':
+		name, _, err := obj.GetAsUserDefined()
+		return name, err
+	case 'U':
+		name, _, err := obj.userMarshalPayload()
+		return name, err
+	case 'C', 'e':
+		name := newMarshalledObject(obj.MajorVersion, obj.MinorVersion, obj.data[1:], obj.symbolCache, obj.objectCache)
+		return name.GetAsString()
+	default:
+		return "", TypeMismatch
+	}
+}
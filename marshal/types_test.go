@@ -0,0 +1,221 @@
+package marshal
+
+import (
+	"math/big"
+	"testing"
+)
+
+// encodeBignumBytes packs value into the `l` (Bignum) wire format: a sign
+// byte, a compact-int word count, then the magnitude as little-endian
+// 16-bit words, mirroring what Ruby's Marshal writer produces.
+func encodeBignumBytes(value *big.Int) []byte {
+	sign := byte('+')
+	magnitude := new(big.Int).Abs(value)
+	if value.Sign() < 0 {
+		sign = '-'
+	}
+
+	big_endian := magnitude.Bytes()
+	if len(big_endian)%2 != 0 {
+		big_endian = append([]byte{0}, big_endian...)
+	}
+
+	little_endian := make([]byte, len(big_endian))
+	for i, b := range big_endian {
+		little_endian[len(big_endian)-1-i] = b
+	}
+
+	data := []byte{'l', sign, byte(len(little_endian)/2 + 5)}
+	return append(data, little_endian...)
+}
+
+func TestGetAsBignum(t *testing.T) {
+	want := big.NewInt(123456789012345)
+	obj := CreateMarshalledObject(append([]byte{4, 8}, encodeBignumBytes(want)...))
+
+	got, err := obj.GetAsBignum()
+	if err != nil {
+		t.Fatalf("GetAsBignum: %v", err)
+	}
+	if got.Cmp(want) != 0 {
+		t.Fatalf("GetAsBignum() = %s, want %s", got, want)
+	}
+}
+
+func TestGetAsBignumNegative(t *testing.T) {
+	want := big.NewInt(-42000000000)
+	obj := CreateMarshalledObject(append([]byte{4, 8}, encodeBignumBytes(want)...))
+
+	got, err := obj.GetAsBignum()
+	if err != nil {
+		t.Fatalf("GetAsBignum: %v", err)
+	}
+	if got.Cmp(want) != 0 {
+		t.Fatalf("GetAsBignum() = %s, want %s", got, want)
+	}
+}
+
+func TestGetAsRegexp(t *testing.T) {
+	// /ab/ with no options: '/', length-prefixed "ab", a zero options byte.
+	data := []byte{4, 8, '/', 7, 'a', 'b', 0}
+	obj := CreateMarshalledObject(data)
+
+	pattern, opts, err := obj.GetAsRegexp()
+	if err != nil {
+		t.Fatalf("GetAsRegexp: %v", err)
+	}
+	if pattern != "ab" || opts != 0 {
+		t.Fatalf("GetAsRegexp() = (%q, %d), want (\"ab\", 0)", pattern, opts)
+	}
+}
+
+func TestGetAsStruct(t *testing.T) {
+	// Struct.new(:x, :y).new(1, 2), class name "Point".
+	data := []byte{
+		4, 8, 'S', ':', 10, 'P', 'o', 'i', 'n', 't',
+		7,
+		':', 6, 'x', 'i', 6,
+		':', 6, 'y', 'i', 7,
+	}
+	obj := CreateMarshalledObject(data)
+
+	name, fields, err := obj.GetAsStruct()
+	if err != nil {
+		t.Fatalf("GetAsStruct: %v", err)
+	}
+	if name != "Point" {
+		t.Fatalf("GetAsStruct() name = %q, want \"Point\"", name)
+	}
+	x, err := fields["x"].GetAsInteger()
+	if err != nil || x != 1 {
+		t.Fatalf("fields[x] = %d, err %v, want 1", x, err)
+	}
+	y, err := fields["y"].GetAsInteger()
+	if err != nil || y != 2 {
+		t.Fatalf("fields[y] = %d, err %v, want 2", y, err)
+	}
+}
+
+// TestCWrappedHash covers a Hash subclass (e.g. Ruby's
+// ActiveSupport::HashWithIndifferentAccess) serialized as a `C`
+// user-class-wrapped built-in: GetType reports TYPE_MAP, and GetAsMap must
+// unwrap the class-name symbol to reach the hash body rather than trying to
+// parse it as hash contents.
+func TestCWrappedHash(t *testing.T) {
+	// C:Foo{1=>"a"}
+	data := []byte{4, 8, 'C', ':', 8, 'F', 'o', 'o', '{', 6, 'i', 6, '"', 6, 'a'}
+	obj := CreateMarshalledObject(data)
+
+	if got := obj.GetType(); got != TYPE_MAP {
+		t.Fatalf("GetType() = %v, want TYPE_MAP", got)
+	}
+
+	className, err := obj.GetClassName()
+	if err != nil || className != "Foo" {
+		t.Fatalf("GetClassName() = (%q, %v), want (\"Foo\", nil)", className, err)
+	}
+
+	m, err := obj.GetAsMap()
+	if err != nil {
+		t.Fatalf("GetAsMap: %v", err)
+	}
+	value, err := m["1"].GetAsString()
+	if err != nil || value != "a" {
+		t.Fatalf("m[\"1\"] = %q, err %v, want \"a\"", value, err)
+	}
+}
+
+// TestHashWithIndifferentAccessDecodesAsMap covers the concrete class Rails
+// ships: ActiveSupport::HashWithIndifferentAccess is dumped as a `C`-wrapped
+// Hash, not via marshal_dump, so it needs no userClassRegistry/
+// userMarshalRegistry entry -- the generic `C` unwrap in GetAsMap is enough.
+func TestHashWithIndifferentAccessDecodesAsMap(t *testing.T) {
+	// C:'ActiveSupport::HashWithIndifferentAccess'{"foo"=>"bar"}
+	className := "ActiveSupport::HashWithIndifferentAccess"
+	data := []byte{4, 8, 'C', ':', byte(len(className) + 5)}
+	data = append(data, []byte(className)...)
+	data = append(data, '{', 6, '"', 8, 'f', 'o', 'o', '"', 8, 'b', 'a', 'r')
+	obj := CreateMarshalledObject(data)
+
+	if got := obj.GetType(); got != TYPE_MAP {
+		t.Fatalf("GetType() = %v, want TYPE_MAP", got)
+	}
+
+	gotClassName, err := obj.GetClassName()
+	if err != nil || gotClassName != className {
+		t.Fatalf("GetClassName() = (%q, %v), want (%q, nil)", gotClassName, err, className)
+	}
+
+	m, err := obj.GetAsMap()
+	if err != nil {
+		t.Fatalf("GetAsMap: %v", err)
+	}
+	value, err := m["foo"].GetAsString()
+	if err != nil || value != "bar" {
+		t.Fatalf("m[\"foo\"] = %q, err %v, want \"bar\"", value, err)
+	}
+}
+
+// TestCWrappedHashBackreference covers an Array holding a `C`-wrapped Hash
+// followed by a later value and a back-reference to that later value.
+// Ruby's writer assigns the wrapped Hash exactly one object link (covering
+// the `C` tag and its payload together), so the subsequent link must land on
+// whatever Ruby really linked next -- not shift by one because decoding the
+// wrapped Hash's size along the way mistakenly registered its unwrapped
+// payload as a second, phantom object.
+func TestCWrappedHashBackreference(t *testing.T) {
+	// [C:Foo{1=>"a"}, "b", @3] -- object links, in Ruby's numbering: 0 the
+	// array, 1 the C-wrapped hash, 2 the string "a" nested inside it, 3 the
+	// string "b"; @3 -> the Fixnum 3 encodes as byte 8 (3+5).
+	data := []byte{4, 8, '[', 8,
+		'C', ':', 8, 'F', 'o', 'o', '{', 6, 'i', 6, '"', 6, 'a',
+		'"', 6, 'b',
+		'@', 8,
+	}
+	obj := CreateMarshalledObject(data)
+
+	arr, err := obj.GetAsArray()
+	if err != nil {
+		t.Fatalf("GetAsArray: %v", err)
+	}
+	if len(arr) != 3 {
+		t.Fatalf("len(arr) = %d, want 3", len(arr))
+	}
+
+	className, err := arr[0].GetClassName()
+	if err != nil || className != "Foo" {
+		t.Fatalf("GetClassName() = (%q, %v), want (\"Foo\", nil)", className, err)
+	}
+
+	if !arr[2].IsCycle() {
+		t.Fatalf("arr[2].IsCycle() = false, want true")
+	}
+	value, err := arr[2].GetAsString()
+	if err != nil || value != "b" {
+		t.Fatalf("arr[2].GetAsString() = (%q, %v), want (\"b\", nil)", value, err)
+	}
+}
+
+// TestCWrappedArray covers the same `C` unwrap for an Array subclass.
+func TestCWrappedArray(t *testing.T) {
+	// C:Foo[1,2]
+	data := []byte{4, 8, 'C', ':', 8, 'F', 'o', 'o', '[', 7, 'i', 6, 'i', 7}
+	obj := CreateMarshalledObject(data)
+
+	if got := obj.GetType(); got != TYPE_ARRAY {
+		t.Fatalf("GetType() = %v, want TYPE_ARRAY", got)
+	}
+
+	arr, err := obj.GetAsArray()
+	if err != nil {
+		t.Fatalf("GetAsArray: %v", err)
+	}
+	if len(arr) != 2 {
+		t.Fatalf("len(arr) = %d, want 2", len(arr))
+	}
+	v0, _ := arr[0].GetAsInteger()
+	v1, _ := arr[1].GetAsInteger()
+	if v0 != 1 || v1 != 2 {
+		t.Fatalf("arr = [%d, %d], want [1, 2]", v0, v1)
+	}
+}
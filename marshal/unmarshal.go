@@ -0,0 +1,491 @@
+package marshal
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+)
+
+// Unmarshaler is implemented by types that know how to decode their own
+// `_dump` payload. Unmarshal consults it whenever it reaches a
+// TYPE_USER_DEFINED value whose target implements the interface.
+type Unmarshaler interface {
+	UnmarshalRubyMarshal(data []byte) error
+}
+
+// Unmarshal parses Marshal-encoded data and stores the result in the value
+// pointed to by v, walking v's type with reflection. Ruby integers, floats,
+// booleans and strings populate their Go counterparts; Ruby arrays populate
+// slices; Ruby hashes populate maps or, for struct targets, fields tagged
+// `marshal:"name"` (matched against either the hash's string key or Ruby
+// symbol). Ruby object instances and ivar-wrapped values populate struct
+// fields the same way, with the leading `@` stripped from ivar names.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("gorails/marshal: Unmarshal target must be a non-nil pointer")
+	}
+
+	return unmarshalValue(CreateMarshalledObject(data), rv.Elem())
+}
+
+func unmarshalValue(obj *MarshalledObject, rv reflect.Value) error {
+	if rv.CanAddr() && obj.GetType() == TYPE_USER_DEFINED {
+		if u, ok := rv.Addr().Interface().(Unmarshaler); ok {
+			_, payload, err := obj.GetAsUserDefined()
+			if err != nil {
+				return err
+			}
+			return u.UnmarshalRubyMarshal(payload)
+		}
+	}
+
+	if rv.Kind() == reflect.Interface && rv.NumMethod() == 0 {
+		value, err := dynamicValue(obj)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			rv.Set(reflect.Zero(rv.Type()))
+		} else {
+			rv.Set(reflect.ValueOf(value))
+		}
+		return nil
+	}
+
+	switch obj.GetType() {
+	case TYPE_NIL:
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+
+	case TYPE_BOOL:
+		value, err := obj.GetAsBool()
+		if err != nil {
+			return err
+		}
+		if rv.Kind() != reflect.Bool {
+			return fmt.Errorf("gorails/marshal: cannot unmarshal bool into %s", rv.Type())
+		}
+		rv.SetBool(value)
+		return nil
+
+	case TYPE_INTEGER:
+		value, err := obj.GetAsInteger()
+		if err != nil {
+			return err
+		}
+		return setNumber(rv, float64(value), value)
+
+	case TYPE_FLOAT:
+		value, err := obj.GetAsFloat()
+		if err != nil {
+			return err
+		}
+		return setNumber(rv, value, int64(value))
+
+	case TYPE_STRING:
+		value, err := obj.GetAsString()
+		if err != nil {
+			return err
+		}
+		if rv.Kind() != reflect.String {
+			return fmt.Errorf("gorails/marshal: cannot unmarshal string into %s", rv.Type())
+		}
+		rv.SetString(value)
+		return nil
+
+	case TYPE_ARRAY:
+		array, err := obj.GetAsArray()
+		if err != nil {
+			return err
+		}
+		if rv.Kind() != reflect.Slice {
+			return fmt.Errorf("gorails/marshal: cannot unmarshal array into %s", rv.Type())
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(array), len(array))
+		for i, elem := range array {
+			if err := unmarshalValue(elem, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+		return nil
+
+	case TYPE_MAP:
+		// A C/e-wrapped Hash (e.g. HashWithIndifferentAccess) carries its
+		// class-name symbol ahead of the hash body.
+		core := obj
+		if obj.data[0] == 'C' || obj.data[0] == 'e' {
+			wrapped, _, err := obj.wrappedValue()
+			if err != nil {
+				return err
+			}
+			core = wrapped
+		}
+		pairs, err := core.getMaplike(true)
+		if err != nil {
+			return err
+		}
+		return unmarshalMaplike(pairs, rv)
+
+	case TYPE_INSTANCE_VARIABLES:
+		wrapped, ivars, err := obj.GetAsInstanceVariables()
+		if err != nil {
+			return err
+		}
+		if rv.Kind() == reflect.Struct {
+			return unmarshalIvarsIntoStruct(ivars, rv)
+		}
+		return unmarshalValue(wrapped, rv)
+
+	case TYPE_OBJECT_INSTANCE:
+		_, ivars, err := obj.GetAsObjectInstance()
+		if err != nil {
+			return err
+		}
+		if rv.Kind() != reflect.Struct {
+			return fmt.Errorf("gorails/marshal: cannot unmarshal object into %s", rv.Type())
+		}
+		return unmarshalIvarsIntoStruct(ivars, rv)
+
+	case TYPE_USER_DEFINED:
+		className, payload, err := obj.GetAsUserDefined()
+		if err != nil {
+			return err
+		}
+		loader, ok := lookupUserClass(className)
+		if !ok {
+			return fmt.Errorf("gorails/marshal: no registered loader for user-defined class %q", className)
+		}
+		value, err := loader(payload)
+		if err != nil {
+			return err
+		}
+		return setReflectValue(rv, value)
+
+	case TYPE_USER_MARSHAL:
+		className, wrapped, err := obj.userMarshalPayload()
+		if err != nil {
+			return err
+		}
+		loader, ok := lookupUserMarshal(className)
+		if !ok {
+			return fmt.Errorf("gorails/marshal: no registered loader for user-marshal class %q", className)
+		}
+		value, err := loader(wrapped)
+		if err != nil {
+			return err
+		}
+		return setReflectValue(rv, value)
+
+	case TYPE_DATA:
+		className, wrapped, err := obj.GetAsData()
+		if err != nil {
+			return err
+		}
+		loader, ok := lookupUserMarshal(className)
+		if !ok {
+			return fmt.Errorf("gorails/marshal: no registered loader for data class %q", className)
+		}
+		value, err := loader(wrapped)
+		if err != nil {
+			return err
+		}
+		return setReflectValue(rv, value)
+
+	case TYPE_BIGNUM:
+		value, err := obj.GetAsBignum()
+		if err != nil {
+			return err
+		}
+		return setBignum(rv, value)
+
+	case TYPE_STRUCT:
+		_, fields, err := obj.GetAsStruct()
+		if err != nil {
+			return err
+		}
+		return unmarshalNamedFields(fields, rv)
+
+	case TYPE_REGEXP:
+		pattern, _, err := obj.GetAsRegexp()
+		if err != nil {
+			return err
+		}
+		if rv.Kind() != reflect.String {
+			return fmt.Errorf("gorails/marshal: cannot unmarshal regexp into %s", rv.Type())
+		}
+		rv.SetString(pattern)
+		return nil
+
+	case TYPE_CLASS, TYPE_MODULE, TYPE_CLASS_OR_MODULE:
+		name, err := obj.GetAsString()
+		if err != nil {
+			return err
+		}
+		if rv.Kind() != reflect.String {
+			return fmt.Errorf("gorails/marshal: cannot unmarshal class/module name into %s", rv.Type())
+		}
+		rv.SetString(name)
+		return nil
+
+	default:
+		return fmt.Errorf("gorails/marshal: cannot unmarshal type %v", obj.GetType())
+	}
+}
+
+// setBignum assigns a Bignum to any Go numeric kind, or to a *big.Int
+// target directly.
+func setBignum(rv reflect.Value, value *big.Int) error {
+	if rv.Type() == reflect.TypeOf(value) {
+		rv.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		rv.SetInt(value.Int64())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		rv.SetUint(value.Uint64())
+	case reflect.Float32, reflect.Float64:
+		f, _ := new(big.Float).SetInt(value).Float64()
+		rv.SetFloat(f)
+	default:
+		return fmt.Errorf("gorails/marshal: cannot unmarshal bignum into %s", rv.Type())
+	}
+	return nil
+}
+
+// unmarshalNamedFields populates rv from a name-to-value map the way
+// unmarshalIvarsIntoStruct does for struct targets, or into a string-keyed
+// map for map targets. Used for Struct members, which share the same shape
+// as object instance ivars but aren't prefixed with `@`.
+func unmarshalNamedFields(fields map[string]*MarshalledObject, rv reflect.Value) error {
+	switch rv.Kind() {
+	case reflect.Struct:
+		return unmarshalIvarsIntoStruct(fields, rv)
+
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("gorails/marshal: cannot unmarshal named fields into %s", rv.Type())
+		}
+		m := reflect.MakeMapWithSize(rv.Type(), len(fields))
+		for name, v := range fields {
+			key := reflect.New(rv.Type().Key()).Elem()
+			key.SetString(name)
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := unmarshalValue(v, elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		rv.Set(m)
+		return nil
+
+	default:
+		return fmt.Errorf("gorails/marshal: cannot unmarshal named fields into %s", rv.Type())
+	}
+}
+
+// setNumber assigns a Ruby numeric value to a Go integer or float kind,
+// using asFloat for float targets and asInt otherwise; complex targets are
+// rejected with an error.
+func setNumber(rv reflect.Value, asFloat float64, asInt int64) error {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		rv.SetInt(asInt)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		rv.SetUint(uint64(asInt))
+	case reflect.Float32, reflect.Float64:
+		rv.SetFloat(asFloat)
+	default:
+		return fmt.Errorf("gorails/marshal: cannot unmarshal number into %s", rv.Type())
+	}
+	return nil
+}
+
+// setReflectValue stores a Go value produced by a registered user-class or
+// user-marshal loader into rv.
+func setReflectValue(rv reflect.Value, value interface{}) error {
+	if value == nil {
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+	}
+
+	rv2 := reflect.ValueOf(value)
+	if !rv2.Type().AssignableTo(rv.Type()) {
+		return fmt.Errorf("gorails/marshal: cannot assign %s into %s", rv2.Type(), rv.Type())
+	}
+	rv.Set(rv2)
+
+	return nil
+}
+
+func unmarshalMaplike(pairs map[*MarshalledObject]*MarshalledObject, rv reflect.Value) error {
+	switch rv.Kind() {
+	case reflect.Map:
+		m := reflect.MakeMapWithSize(rv.Type(), len(pairs))
+		for k, v := range pairs {
+			key := reflect.New(rv.Type().Key()).Elem()
+			if err := unmarshalValue(k, key); err != nil {
+				return err
+			}
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := unmarshalValue(v, elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		rv.Set(m)
+		return nil
+
+	case reflect.Struct:
+		fields := make(map[string]*MarshalledObject, len(pairs))
+		for k, v := range pairs {
+			fields[k.ToString()] = v
+		}
+		return unmarshalIvarsIntoStruct(fields, rv)
+
+	default:
+		return fmt.Errorf("gorails/marshal: cannot unmarshal hash into %s", rv.Type())
+	}
+}
+
+// unmarshalIvarsIntoStruct populates rv's fields from a name-to-value map,
+// matching each field against its `marshal:"name"` tag (falling back to the
+// field name) with any leading `@` stripped from the source name.
+func unmarshalIvarsIntoStruct(fields map[string]*MarshalledObject, rv reflect.Value) error {
+	t := rv.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Tag.Get("marshal")
+		if name == "" {
+			name = field.Name
+		}
+
+		value, ok := fields[name]
+		if !ok {
+			value, ok = fields["@"+name]
+		}
+		if !ok {
+			continue
+		}
+
+		if err := unmarshalValue(value, rv.Field(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dynamicValue decodes obj into the same Go primitives CreateMarshalledObject
+// callers already use (nil, bool, int64, float64, string, []interface{},
+// map[string]interface{}), for use with interface{} unmarshal targets.
+func dynamicValue(obj *MarshalledObject) (interface{}, error) {
+	switch obj.GetType() {
+	case TYPE_NIL:
+		return nil, nil
+	case TYPE_BOOL:
+		return obj.GetAsBool()
+	case TYPE_INTEGER:
+		return obj.GetAsInteger()
+	case TYPE_FLOAT:
+		return obj.GetAsFloat()
+	case TYPE_STRING:
+		return obj.GetAsString()
+	case TYPE_ARRAY:
+		array, err := obj.GetAsArray()
+		if err != nil {
+			return nil, err
+		}
+		out := make([]interface{}, len(array))
+		for i, elem := range array {
+			v, err := dynamicValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	case TYPE_MAP:
+		m, err := obj.GetAsMap()
+		if err != nil {
+			return nil, err
+		}
+		out := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			dv, err := dynamicValue(v)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = dv
+		}
+		return out, nil
+	case TYPE_INSTANCE_VARIABLES:
+		wrapped, _, err := obj.GetAsInstanceVariables()
+		if err != nil {
+			return nil, err
+		}
+		return dynamicValue(wrapped)
+	case TYPE_USER_DEFINED:
+		className, payload, err := obj.GetAsUserDefined()
+		if err != nil {
+			return nil, err
+		}
+		loader, ok := lookupUserClass(className)
+		if !ok {
+			return nil, fmt.Errorf("gorails/marshal: no registered loader for user-defined class %q", className)
+		}
+		return loader(payload)
+	case TYPE_USER_MARSHAL:
+		className, wrapped, err := obj.userMarshalPayload()
+		if err != nil {
+			return nil, err
+		}
+		loader, ok := lookupUserMarshal(className)
+		if !ok {
+			return nil, fmt.Errorf("gorails/marshal: no registered loader for user-marshal class %q", className)
+		}
+		return loader(wrapped)
+	case TYPE_DATA:
+		className, wrapped, err := obj.GetAsData()
+		if err != nil {
+			return nil, err
+		}
+		loader, ok := lookupUserMarshal(className)
+		if !ok {
+			return nil, fmt.Errorf("gorails/marshal: no registered loader for data class %q", className)
+		}
+		return loader(wrapped)
+	case TYPE_BIGNUM:
+		return obj.GetAsBignum()
+	case TYPE_STRUCT:
+		_, fields, err := obj.GetAsStruct()
+		if err != nil {
+			return nil, err
+		}
+		out := make(map[string]interface{}, len(fields))
+		for name, field := range fields {
+			value, err := dynamicValue(field)
+			if err != nil {
+				return nil, err
+			}
+			out[name] = value
+		}
+		return out, nil
+	case TYPE_REGEXP:
+		pattern, _, err := obj.GetAsRegexp()
+		return pattern, err
+	case TYPE_CLASS, TYPE_MODULE, TYPE_CLASS_OR_MODULE:
+		return obj.GetAsString()
+	default:
+		return nil, fmt.Errorf("gorails/marshal: cannot unmarshal type %v into interface{}", obj.GetType())
+	}
+}
@@ -0,0 +1,126 @@
+package marshal
+
+import (
+	"math/big"
+	"testing"
+)
+
+// TestUnmarshalBignum covers TYPE_BIGNUM, both into a *big.Int and into a
+// plain numeric field.
+func TestUnmarshalBignum(t *testing.T) {
+	want := big.NewInt(123456789012345)
+	data := append([]byte{4, 8}, encodeBignumBytes(want)...)
+
+	var asBig *big.Int
+	if err := Unmarshal(data, &asBig); err != nil {
+		t.Fatalf("Unmarshal into *big.Int: %v", err)
+	}
+	if asBig.Cmp(want) != 0 {
+		t.Fatalf("Unmarshal() = %s, want %s", asBig, want)
+	}
+
+	var asInt int64
+	if err := Unmarshal(data, &asInt); err != nil {
+		t.Fatalf("Unmarshal into int64: %v", err)
+	}
+	if asInt != want.Int64() {
+		t.Fatalf("Unmarshal() = %d, want %d", asInt, want.Int64())
+	}
+
+	var dyn interface{}
+	if err := Unmarshal(data, &dyn); err != nil {
+		t.Fatalf("Unmarshal into interface{}: %v", err)
+	}
+	if big, ok := dyn.(*big.Int); !ok || big.Cmp(want) != 0 {
+		t.Fatalf("Unmarshal() = %#v, want *big.Int %s", dyn, want)
+	}
+}
+
+// TestUnmarshalRegexp covers TYPE_REGEXP, passed through as the pattern
+// string.
+func TestUnmarshalRegexp(t *testing.T) {
+	// /ab/ with no options.
+	data := []byte{4, 8, '/', 7, 'a', 'b', 0}
+
+	var pattern string
+	if err := Unmarshal(data, &pattern); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if pattern != "ab" {
+		t.Fatalf("Unmarshal() = %q, want \"ab\"", pattern)
+	}
+
+	var dyn interface{}
+	if err := Unmarshal(data, &dyn); err != nil {
+		t.Fatalf("Unmarshal into interface{}: %v", err)
+	}
+	if dyn != "ab" {
+		t.Fatalf("Unmarshal() = %#v, want \"ab\"", dyn)
+	}
+}
+
+// TestUnmarshalStruct covers TYPE_STRUCT, into both a Go struct and a map.
+func TestUnmarshalStruct(t *testing.T) {
+	// Struct.new(:x, :y).new(1, 2), class name "Point".
+	data := []byte{
+		4, 8, 'S', ':', 10, 'P', 'o', 'i', 'n', 't',
+		7,
+		':', 6, 'x', 'i', 6,
+		':', 6, 'y', 'i', 7,
+	}
+
+	var point struct {
+		X int `marshal:"x"`
+		Y int `marshal:"y"`
+	}
+	if err := Unmarshal(data, &point); err != nil {
+		t.Fatalf("Unmarshal into struct: %v", err)
+	}
+	if point.X != 1 || point.Y != 2 {
+		t.Fatalf("Unmarshal() = %+v, want {X:1 Y:2}", point)
+	}
+
+	var m map[string]int
+	if err := Unmarshal(data, &m); err != nil {
+		t.Fatalf("Unmarshal into map: %v", err)
+	}
+	if m["x"] != 1 || m["y"] != 2 {
+		t.Fatalf("Unmarshal() = %v, want map[x:1 y:2]", m)
+	}
+}
+
+// TestUnmarshalClassName covers TYPE_CLASS, passed through as the class
+// name string (TYPE_MODULE and TYPE_CLASS_OR_MODULE share its code path).
+func TestUnmarshalClassName(t *testing.T) {
+	// A Class named Int.
+	data := []byte{4, 8, 'c', 8, 'I', 'n', 't'}
+
+	var name string
+	if err := Unmarshal(data, &name); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if name != "Int" {
+		t.Fatalf("Unmarshal() = %q, want \"Int\"", name)
+	}
+}
+
+// TestUnmarshalData covers TYPE_DATA (the `d`/_dump_data protocol), which
+// shares its wire layout with TYPE_USER_MARSHAL and is resolved through the
+// same userMarshalRegistry.
+func TestUnmarshalData(t *testing.T) {
+	RegisterUserMarshal("GorailsTestDataThing", func(wrapped *MarshalledObject) (interface{}, error) {
+		return wrapped.GetAsString()
+	})
+
+	// d:\x19GorailsTestDataThing"\x07hi
+	data := append([]byte{4, 8, 'd'}, symbolBytes("GorailsTestDataThing")...)
+	data = append(data, '"', 7, 'h', 'i')
+
+	var got string
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got != "hi" {
+		t.Fatalf("Unmarshal() = %q, want \"hi\"", got)
+	}
+}